@@ -1,10 +1,12 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -14,19 +16,91 @@ const (
 	RenewInterval uint64 = 0x01FFFFFFFF
 )
 
+// OverflowPolicy controls what NextContext does once the low 40 bits of
+// w.N reach Ceiling and Renew has not yet refreshed the high bits.
+type OverflowPolicy uint8
+
+const (
+	// PolicyIgnore keeps handing out IDs past Ceiling, exactly like Next
+	// always has. It is the default, so existing callers see no change.
+	PolicyIgnore OverflowPolicy = iota
+	// PolicyError makes NextContext return ErrExhausted instead of an ID.
+	PolicyError
+	// PolicyBlock makes NextContext block the caller until Renew succeeds
+	// or ctx is done.
+	PolicyBlock
+)
+
+// ErrExhausted is returned by NextContext when the low 40 bits of w.N
+// have reached Ceiling and OverflowPolicy is PolicyError.
+var ErrExhausted = errors.New("the low 40 bits are exhausted")
+
+// Layout picks how the 64 bits of an ID are split. The default,
+// LayoutCounter{}, is the classic layout and is what NewWUID installs
+// when no WithLayout option is supplied.
+type Layout interface {
+	isLayout()
+}
+
+// LayoutCounter is the classic layout: Section occupies the top 4 bits,
+// h24 (or h20, when Section != 0) occupies the next 24/20 bits, and the
+// low 40 bits are a local, atomically-incremented counter.
+type LayoutCounter struct{}
+
+func (LayoutCounter) isLayout() {}
+
+// LayoutSnowflake lays the 64 bits out as
+// [Section:4][timestamp:TimeBits][Machine:MachineBits][sequence:SeqBits],
+// producing k-sortable IDs. TimeBits+MachineBits+SeqBits must equal 60.
+// Epoch is the zero point the timestamp is measured from; the timestamp
+// field is masked to TimeBits, so IDs wrap once time.Since(Epoch) exceeds
+// 2^TimeBits milliseconds (e.g. ~34.8 years at TimeBits=40) and Epoch must
+// not be in the future. Machine is refreshed the same way h24 is under
+// LayoutCounter, i.e. through Renew, but installed with ResetSnowflake
+// instead of Reset.
+type LayoutSnowflake struct {
+	Epoch       time.Time
+	TimeBits    uint8
+	MachineBits uint8
+	SeqBits     uint8
+}
+
+func (LayoutSnowflake) isLayout() {}
+
+// Observer lets callers watch renewals and issuance instead of only
+// seeing a log line. OnIDIssued can be called on every single ID handed
+// out, so implementations that do real work there (as opposed to a
+// cheap counter increment) should no-op or downsample it themselves.
+type Observer interface {
+	OnRenewStart(tag string)
+	OnRenewSuccess(tag string, newH24 uint64, took time.Duration)
+	OnRenewFailure(tag string, err error, took time.Duration)
+	OnIDIssued(tag string)
+}
+
 // WUID is for internal use only.
 type WUID struct {
 	sync.Mutex
-	Section uint8
-	N       uint64
-	Tag     string
-	Logger  Logger
-	Renew   func() error
+	Section        uint8
+	N              uint64
+	Tag            string
+	Logger         Logger
+	Renew          func() error
+	OverflowPolicy OverflowPolicy
+	Ceiling        uint64
+	Layout         Layout
+	Machine        uint64
+	Observer       Observer
+	cond           *sync.Cond
+	renewing       bool
+	lastMs         uint64
+	seq            uint64
 }
 
 // NewWUID is for internal use only.
 func NewWUID(tag string, logger Logger, opts ...Option) *WUID {
-	w := &WUID{Tag: tag, Logger: logger}
+	w := &WUID{Tag: tag, Logger: logger, Ceiling: CriticalValue, Layout: LayoutCounter{}}
+	w.cond = sync.NewCond(w)
 	for _, opt := range opts {
 		opt(w)
 	}
@@ -35,31 +109,256 @@ func NewWUID(tag string, logger Logger, opts ...Option) *WUID {
 
 // Next is for internal use only.
 func (w *WUID) Next() uint64 {
+	if sf, ok := w.Layout.(LayoutSnowflake); ok {
+		return w.nextSnowflake(sf)
+	}
+
 	x := atomic.AddUint64(&w.N, 1)
 	if x&0xFFFFFFFFFF >= CriticalValue && x&RenewInterval == 0 {
-		w.Lock()
-		renew := w.Renew
-		w.Unlock()
+		w.asyncRenew()
+	}
+	if w.Observer != nil {
+		w.Observer.OnIDIssued(w.Tag)
+	}
+	return x
+}
 
-		go func() {
-			defer func() {
-				if r := recover(); r != nil && w.Logger != nil {
-					w.Logger.Warn(fmt.Sprintf("[wuid] panic. tag: %s, reason: %+v", w.Tag, r))
+// NextN is for internal use only. It reserves a contiguous range of n
+// IDs with a single atomic.AddUint64 and returns the first one; the
+// caller owns [start, start+n). It only applies to LayoutCounter; n must
+// be positive.
+func (w *WUID) NextN(n int) (start uint64, err error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("n must be positive, but got %d. tag: %s", n, w.Tag)
+	}
+	if _, ok := w.Layout.(LayoutCounter); !ok {
+		return 0, fmt.Errorf("NextN only applies to LayoutCounter. tag: %s", w.Tag)
+	}
+
+	end := atomic.AddUint64(&w.N, uint64(n))
+	start = end - uint64(n) + 1
+
+	if w.crossesRenewBoundary(start, end) {
+		w.asyncRenew()
+	}
+	if w.Observer != nil {
+		for i := 0; i < n; i++ {
+			w.Observer.OnIDIssued(w.Tag)
+		}
+	}
+	return start, nil
+}
+
+// crossesRenewBoundary reports whether [start, end] crosses into the
+// CriticalValue zone, or crosses one of the periodic RenewInterval
+// retry marks. It is for internal use only.
+func (w *WUID) crossesRenewBoundary(start, end uint64) bool {
+	low := func(x uint64) uint64 { return x & 0xFFFFFFFFFF }
+	if low(start) < CriticalValue && low(end) >= CriticalValue {
+		return true
+	}
+
+	step := RenewInterval + 1
+	return (start-1)/step != end/step
+}
+
+// nextSnowflake is for internal use only.
+func (w *WUID) nextSnowflake(sf LayoutSnowflake) uint64 {
+	calls := atomic.AddUint64(&w.N, 1)
+	if calls&RenewInterval == 0 {
+		w.asyncRenew()
+	}
+
+	seqMask := uint64(1)<<sf.SeqBits - 1
+	timeMask := uint64(1)<<sf.TimeBits - 1
+	machineShift := sf.SeqBits
+	timeShift := sf.SeqBits + sf.MachineBits
+
+	w.Lock()
+	defer w.Unlock()
+
+	now := uint64(time.Since(sf.Epoch)/time.Millisecond) & timeMask
+	if now == w.lastMs {
+		w.seq = (w.seq + 1) & seqMask
+		if w.seq == 0 {
+			// the sequence wrapped within the same millisecond: spin
+			// until the clock ticks forward
+			for now == w.lastMs {
+				now = uint64(time.Since(sf.Epoch)/time.Millisecond) & timeMask
+			}
+		}
+	} else {
+		w.seq = 0
+	}
+	w.lastMs = now
+
+	x := now<<timeShift | atomic.LoadUint64(&w.Machine)<<machineShift | w.seq
+	if w.Section != 0 {
+		x = x&0x0FFFFFFFFFFFFFFF | uint64(w.Section)<<60
+	}
+
+	if w.Observer != nil {
+		w.Observer.OnIDIssued(w.Tag)
+	}
+	return x
+}
+
+// NextContext is for internal use only. Unlike Next, it honors
+// OverflowPolicy once the low 40 bits of w.N reach Ceiling: PolicyError
+// returns ErrExhausted and PolicyBlock waits for Renew to succeed or for
+// ctx to be done. Neither policy advances w.N while it's stuck at or
+// past Ceiling, so a caller retrying on ErrExhausted can't march the
+// counter into the section/h24 bits. OverflowPolicy doesn't apply to
+// LayoutSnowflake, which never exhausts w.N the same way, so under that
+// layout NextContext is equivalent to Next.
+func (w *WUID) NextContext(ctx context.Context) (uint64, error) {
+	if sf, ok := w.Layout.(LayoutSnowflake); ok {
+		return w.nextSnowflake(sf), nil
+	}
+
+	for {
+		cur := atomic.LoadUint64(&w.N)
+		if cur&0xFFFFFFFFFF >= w.Ceiling {
+			switch w.OverflowPolicy {
+			case PolicyError:
+				w.asyncRenew()
+				return 0, ErrExhausted
+			case PolicyBlock:
+				if err := w.waitForRenew(ctx); err != nil {
+					return 0, err
 				}
-			}()
+				continue
+			}
+			// PolicyIgnore falls through and keeps incrementing below,
+			// exactly like Next always has.
+		}
+
+		x := cur + 1
+		if !atomic.CompareAndSwapUint64(&w.N, cur, x) {
+			continue
+		}
+		if low := x & 0xFFFFFFFFFF; low >= CriticalValue && x&RenewInterval == 0 {
+			w.asyncRenew()
+		}
+		if w.Observer != nil {
+			w.Observer.OnIDIssued(w.Tag)
+		}
+		return x, nil
+	}
+}
 
-			err := renew()
-			if w.Logger == nil {
-				return
+// asyncRenew kicks off w.Renew in the background, unless one is already
+// in flight. It is for internal use only.
+func (w *WUID) asyncRenew() {
+	w.Lock()
+	if w.renewing {
+		w.Unlock()
+		return
+	}
+	w.renewing = true
+	renew := w.Renew
+	w.Unlock()
+
+	go func() {
+		defer func() {
+			w.Lock()
+			w.renewing = false
+			w.Unlock()
+			w.cond.Broadcast()
+		}()
+		defer func() {
+			if r := recover(); r != nil && w.Logger != nil {
+				w.Logger.Warn(fmt.Sprintf("[wuid] panic. tag: %s, reason: %+v", w.Tag, r))
 			}
+		}()
+
+		if w.Observer != nil {
+			w.Observer.OnRenewStart(w.Tag)
+		}
+		started := time.Now()
+		err := renew()
+		took := time.Since(started)
+
+		if w.Observer != nil {
 			if err != nil {
-				w.Logger.Warn(fmt.Sprintf("[wuid] renew failed. tag: %s, reason: %s", w.Tag, err.Error()))
+				w.Observer.OnRenewFailure(w.Tag, err, took)
 			} else {
-				w.Logger.Info(fmt.Sprintf("[wuid] renew succeeded. tag: %s", w.Tag))
+				w.Observer.OnRenewSuccess(w.Tag, w.currentHighBits(), took)
+			}
+		}
+
+		if w.Logger == nil {
+			return
+		}
+		if err != nil {
+			w.Logger.Warn(fmt.Sprintf("[wuid] renew failed. tag: %s, reason: %s", w.Tag, err.Error()))
+		} else {
+			w.Logger.Info(fmt.Sprintf("[wuid] renew succeeded. tag: %s", w.Tag))
+		}
+	}()
+}
+
+// currentHighBits returns the bits that Renew just refreshed: h24/h20
+// under LayoutCounter, or Machine under LayoutSnowflake. It is for
+// internal use only.
+func (w *WUID) currentHighBits() uint64 {
+	if _, ok := w.Layout.(LayoutSnowflake); ok {
+		return atomic.LoadUint64(&w.Machine)
+	}
+	n := atomic.LoadUint64(&w.N)
+	if w.Section != 0 {
+		n &= 0x0FFFFFFFFFFFFFFF
+	}
+	return n >> 40
+}
+
+// waitForRenew blocks until a renewal brings w.N back under Ceiling or
+// ctx is done; with a nil ctx it waits for the renewal alone. A failed
+// renewal doesn't stop
+// the wait: it retries on every wake-up until one succeeds. It is for
+// internal use only.
+func (w *WUID) waitForRenew(ctx context.Context) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	if ctx != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.cond.Broadcast()
+			case <-stopped:
 			}
 		}()
 	}
-	return x
+
+	w.Lock()
+	defer w.Unlock()
+
+	for atomic.LoadUint64(&w.N)&0xFFFFFFFFFF >= w.Ceiling {
+		if ctx != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+
+		w.Unlock()
+		w.asyncRenew()
+		w.Lock()
+
+		// asyncRenew only spawns a goroutine; if it already ran to
+		// completion and broadcast before we got the lock back, Wait
+		// would miss it and block forever. Recheck before waiting, and
+		// go round again if that renewal already finished and failed.
+		if atomic.LoadUint64(&w.N)&0xFFFFFFFFFF < w.Ceiling {
+			break
+		}
+		if !w.renewing {
+			continue
+		}
+		w.cond.Wait()
+	}
+	return nil
 }
 
 // Reset is for internal use only.
@@ -90,6 +389,26 @@ func (w *WUID) VerifyH24(h24 uint64) error {
 	return nil
 }
 
+// ResetSnowflake is for internal use only. It is the LayoutSnowflake
+// counterpart to Reset: it installs a freshly-renewed Machine id.
+func (w *WUID) ResetSnowflake(machine uint64) {
+	atomic.StoreUint64(&w.Machine, machine)
+}
+
+// VerifySnowflake is for internal use only. It is the LayoutSnowflake
+// counterpart to VerifyH24.
+func (w *WUID) VerifySnowflake(sf LayoutSnowflake, machine uint64) error {
+	if machine == 0 {
+		return errors.New("the machine id should not be 0. tag: " + w.Tag)
+	}
+
+	if max := uint64(1)<<sf.MachineBits - 1; machine > max {
+		return fmt.Errorf("the machine id should not exceed %#x. tag: %s", max, w.Tag)
+	}
+
+	return nil
+}
+
 // Logger is for internal use only.
 type Logger interface {
 	Info(args ...interface{})
@@ -108,3 +427,39 @@ func WithSection(section uint8) Option {
 		w.Section = section
 	}
 }
+
+// WithOverflowPolicy is for internal use only.
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(w *WUID) {
+		w.OverflowPolicy = policy
+	}
+}
+
+// WithCeiling is for internal use only.
+func WithCeiling(ceiling uint64) Option {
+	if ceiling == 0 || ceiling > 1<<40 {
+		panic("ceiling must be in between (0, 1<<40]")
+	}
+	return func(w *WUID) {
+		w.Ceiling = ceiling
+	}
+}
+
+// WithLayout is for internal use only.
+func WithLayout(layout Layout) Option {
+	if sf, ok := layout.(LayoutSnowflake); ok {
+		if uint16(sf.TimeBits)+uint16(sf.MachineBits)+uint16(sf.SeqBits) != 60 {
+			panic("TimeBits + MachineBits + SeqBits must equal 60")
+		}
+	}
+	return func(w *WUID) {
+		w.Layout = layout
+	}
+}
+
+// WithObserver is for internal use only.
+func WithObserver(observer Observer) Option {
+	return func(w *WUID) {
+		w.Observer = observer
+	}
+}
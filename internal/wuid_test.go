@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNextContextPolicyError(t *testing.T) {
+	w := NewWUID("tag", nil, WithOverflowPolicy(PolicyError), WithCeiling(10))
+	w.Renew = func() error { return errors.New("boom") }
+	atomic.StoreUint64(&w.N, 10)
+
+	if _, err := w.NextContext(context.Background()); err != ErrExhausted {
+		t.Fatalf("expected ErrExhausted, got %v", err)
+	}
+}
+
+func TestNextContextPolicyErrorDoesNotConsumeN(t *testing.T) {
+	w := NewWUID("tag", nil, WithOverflowPolicy(PolicyError), WithCeiling(10))
+	w.Renew = func() error { return errors.New("boom") }
+	atomic.StoreUint64(&w.N, 10)
+
+	for i := 0; i < 1000; i++ {
+		if _, err := w.NextContext(context.Background()); err != ErrExhausted {
+			t.Fatalf("call %d: expected ErrExhausted, got %v", i, err)
+		}
+	}
+	if got := atomic.LoadUint64(&w.N); got != 10 {
+		t.Fatalf("expected w.N to stay at 10 across repeated ErrExhausted calls, got %d", got)
+	}
+}
+
+func TestNextContextPolicyBlock(t *testing.T) {
+	w := NewWUID("tag", nil, WithOverflowPolicy(PolicyBlock), WithCeiling(10))
+	var tries int32
+	w.Renew = func() error {
+		if atomic.AddInt32(&tries, 1) < 2 {
+			return errors.New("not yet")
+		}
+		atomic.StoreUint64(&w.N, 0)
+		return nil
+	}
+	atomic.StoreUint64(&w.N, 10)
+
+	done := make(chan uint64, 1)
+	go func() {
+		x, err := w.NextContext(context.Background())
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		done <- x
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("NextContext did not unblock once Renew succeeded")
+	}
+}
+
+func TestNextContextPolicyBlockFastRenewDoesNotHang(t *testing.T) {
+	// Renew here returns essentially instantly, maximizing the odds that
+	// asyncRenew's goroutine runs to completion (and broadcasts) before
+	// waitForRenew gets the lock back -- the window where a lost wakeup
+	// would hang this forever without the post-relock recheck.
+	for i := 0; i < 200; i++ {
+		w := NewWUID("tag", nil, WithOverflowPolicy(PolicyBlock), WithCeiling(10))
+		w.Renew = func() error {
+			atomic.StoreUint64(&w.N, 0)
+			return nil
+		}
+		atomic.StoreUint64(&w.N, 10)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if _, err := w.NextContext(ctx); err != nil {
+			cancel()
+			t.Fatalf("iteration %d: NextContext did not unblock in time: %v", i, err)
+		}
+		cancel()
+	}
+}
+
+func TestNextContextPolicyBlockCtxCanceled(t *testing.T) {
+	w := NewWUID("tag", nil, WithOverflowPolicy(PolicyBlock), WithCeiling(10))
+	w.Renew = func() error { return errors.New("never recovers") }
+	atomic.StoreUint64(&w.N, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := w.NextContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestNextNRejectsSnowflakeLayout(t *testing.T) {
+	w := NewWUID("tag", nil, WithLayout(LayoutSnowflake{
+		Epoch: time.Now(), TimeBits: 40, MachineBits: 10, SeqBits: 10,
+	}))
+
+	if _, err := w.NextN(5); err == nil {
+		t.Fatal("expected an error reserving a range on a LayoutSnowflake WUID")
+	}
+}
+
+func TestNextNRange(t *testing.T) {
+	w := NewWUID("tag", nil)
+
+	start, err := w.NextN(5)
+	if err != nil {
+		t.Fatalf("NextN: %v", err)
+	}
+	if start != 1 {
+		t.Fatalf("expected the first reserved id to be 1, got %d", start)
+	}
+	if got := atomic.LoadUint64(&w.N); got != 5 {
+		t.Fatalf("expected w.N == 5 after reserving 5 ids, got %d", got)
+	}
+
+	start2, err := w.NextN(3)
+	if err != nil {
+		t.Fatalf("NextN: %v", err)
+	}
+	if start2 != 6 {
+		t.Fatalf("expected the second range to start at 6, got %d", start2)
+	}
+}
+
+func TestCrossesRenewBoundary(t *testing.T) {
+	w := NewWUID("tag", nil)
+	step := RenewInterval + 1
+
+	if !w.crossesRenewBoundary(step, step+5) {
+		t.Fatal("expected a range starting exactly on a RenewInterval multiple to cross")
+	}
+	if w.crossesRenewBoundary(step+1, step+5) {
+		t.Fatal("expected a range strictly inside one interval to not cross")
+	}
+}
+
+func TestNextNTriggersRenewOnBoundary(t *testing.T) {
+	var renewed int32
+	w := NewWUID("tag", nil)
+	w.Renew = func() error {
+		atomic.AddInt32(&renewed, 1)
+		return nil
+	}
+
+	step := RenewInterval + 1
+	atomic.StoreUint64(&w.N, step-1)
+
+	if _, err := w.NextN(6); err != nil {
+		t.Fatalf("NextN: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&renewed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&renewed) == 0 {
+		t.Fatal("expected Renew to fire for a range starting exactly on a RenewInterval boundary")
+	}
+}
+
+func TestNextSnowflakeSpinOnSequenceWrap(t *testing.T) {
+	w := NewWUID("tag", nil, WithLayout(LayoutSnowflake{
+		Epoch: time.Now().Add(-time.Hour), TimeBits: 50, MachineBits: 10, SeqBits: 0,
+	}))
+
+	// With SeqBits == 0 every call within the same millisecond wraps the
+	// sequence straight back to 0, forcing the spin-until-next-ms path.
+	id1 := w.Next()
+	id2 := w.Next()
+	if id2 <= id1 {
+		t.Fatalf("expected strictly increasing ids across the spin, got %d then %d", id1, id2)
+	}
+}
+
+func TestNextSnowflakeMasksTimestamp(t *testing.T) {
+	// Epoch is far enough in the past that the raw millisecond offset
+	// overflows TimeBits; without masking, the high bits would spill past
+	// the timestamp field into the section bits above it. The machine
+	// field below must stay intact either way.
+	w := NewWUID("tag", nil, WithLayout(LayoutSnowflake{
+		Epoch: time.Unix(0, 0), TimeBits: 10, MachineBits: 10, SeqBits: 40,
+	}))
+	atomic.StoreUint64(&w.Machine, 7)
+
+	id := w.Next()
+	if section := id >> 60; section != 0 {
+		t.Fatalf("expected the masked timestamp to leave the section bits at 0, got %d", section)
+	}
+	if machine := (id >> 40) & 0x3FF; machine != 7 {
+		t.Fatalf("expected the masked timestamp to leave the machine bits at 7, got %d", machine)
+	}
+}
+
+func TestNextContextDispatchesToSnowflake(t *testing.T) {
+	w := NewWUID("tag", nil, WithLayout(LayoutSnowflake{
+		Epoch: time.Now(), TimeBits: 40, MachineBits: 10, SeqBits: 10,
+	}))
+	atomic.StoreUint64(&w.Machine, 3)
+
+	x, err := w.NextContext(context.Background())
+	if err != nil {
+		t.Fatalf("NextContext: %v", err)
+	}
+	if machine := (x >> 10) & 0x3FF; machine != 3 {
+		t.Fatalf("expected the snowflake-packed machine bits to be 3, got %d", machine)
+	}
+}
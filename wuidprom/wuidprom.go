@@ -0,0 +1,70 @@
+// Package wuidprom implements internal.Observer with Prometheus metrics,
+// so operators can alert on renewal failures and track renewal latency
+// instead of only having a log line to go on.
+package wuidprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weylan/wuid/internal"
+)
+
+// Observer is a Prometheus-backed internal.Observer. Create one with
+// NewObserver; the zero value is not usable.
+type Observer struct {
+	renewTotal    *prometheus.CounterVec
+	renewDuration *prometheus.HistogramVec
+	idsIssued     *prometheus.CounterVec
+}
+
+var _ internal.Observer = (*Observer)(nil)
+
+// NewObserver creates an Observer and registers its metrics with reg. Use
+// prometheus.DefaultRegisterer if the caller doesn't have a dedicated
+// registry.
+func NewObserver(reg prometheus.Registerer) *Observer {
+	o := &Observer{
+		renewTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wuid",
+			Name:      "renew_total",
+			Help:      "Total number of renewal attempts, by tag and result.",
+		}, []string{"tag", "result"}),
+		renewDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "wuid",
+			Name:      "renew_duration_seconds",
+			Help:      "Renewal latency in seconds, by tag.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"tag"}),
+		idsIssued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wuid",
+			Name:      "ids_issued_total",
+			Help:      "Total number of IDs issued, by tag.",
+		}, []string{"tag"}),
+	}
+	reg.MustRegister(o.renewTotal, o.renewDuration, o.idsIssued)
+	return o
+}
+
+// OnRenewStart implements internal.Observer.
+func (o *Observer) OnRenewStart(tag string) {}
+
+// OnRenewSuccess implements internal.Observer.
+func (o *Observer) OnRenewSuccess(tag string, newH24 uint64, took time.Duration) {
+	o.renewTotal.WithLabelValues(tag, "success").Inc()
+	o.renewDuration.WithLabelValues(tag).Observe(took.Seconds())
+}
+
+// OnRenewFailure implements internal.Observer.
+func (o *Observer) OnRenewFailure(tag string, err error, took time.Duration) {
+	o.renewTotal.WithLabelValues(tag, "failure").Inc()
+	o.renewDuration.WithLabelValues(tag).Observe(took.Seconds())
+}
+
+// OnIDIssued implements internal.Observer. It is sampled nowhere here
+// since a Counter.Inc() is cheap; callers issuing at extreme rates can
+// wrap Observer and downsample before calling this.
+func (o *Observer) OnIDIssued(tag string) {
+	o.idsIssued.WithLabelValues(tag).Inc()
+}